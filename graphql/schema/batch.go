@@ -0,0 +1,257 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// batchOptions is the parsed form of @custom(http: {mode: BATCH, groupBy:
+// ..., dedupe: ...}). userNamesHandler, teacherNamesHandler and friends in
+// graphql/e2e/custom_logic/cmd already speak this "array of parents in,
+// array of results out" protocol by convention; batchOptions is what lets
+// the @custom resolver build that array automatically instead of every
+// mock/remote endpoint needing to hand-roll it.
+type batchOptions struct {
+	// Window is how long sibling field invocations within a single
+	// GraphQL request (and, if non-zero, across concurrent requests) are
+	// collected before the outbound call is made.
+	Window time.Duration
+	// GroupBy, if set, groups parents sharing the same value for this
+	// field into a single outbound entry rather than one per parent.
+	GroupBy string
+	Dedupe  bool
+}
+
+// batchKey identifies one pending parent awaiting a batched call: its
+// per-parent template variables (used to build its entry in the outbound
+// body via parseBodyTemplate) and the channel its individual result should
+// be delivered on.
+type batchKey struct {
+	vars   map[string]interface{}
+	result chan batchResult
+}
+
+type batchResult struct {
+	val interface{}
+	err error
+}
+
+// batcher coalesces calls to a single @custom(mode: BATCH) field into one
+// outbound request per window, then demultiplexes the response back to
+// each caller - the dataloader pattern.
+//
+// queued is partitioned by reqID (one bucket per concurrent GraphQL
+// request sharing this field) so that the siblingCount-based flush below
+// only ever fires against the entries its own request enqueued - without
+// that, two concurrent requests hitting the same batched field would
+// interleave their entries in one queue and whichever request's threshold
+// was reached first would flush a mix of both requests' incomplete
+// entries. When opts.Window is non-zero, coalescing across requests is the
+// point, so the timer-driven flush collapses every bucket together
+// regardless of reqID.
+type batcher struct {
+	opts   batchOptions
+	send   func(vars []map[string]interface{}) ([]interface{}, error)
+	mu     sync.Mutex
+	timer  *time.Timer
+	queued map[string][]batchKey
+}
+
+// newBatcher builds a batcher that flushes via send, which should perform
+// the single outbound POST (its body built from parseBodyTemplate applied
+// per-parent) and return one result per entry of vars, in the same order.
+func newBatcher(opts batchOptions, send func(vars []map[string]interface{}) ([]interface{}, error)) *batcher {
+	return &batcher{opts: opts, send: send, queued: map[string][]batchKey{}}
+}
+
+// load enqueues vars for the next flush and blocks until this caller's
+// result is available.
+//
+// reqID identifies the GraphQL request this call belongs to - the resolver
+// framework's per-request identifier, threaded in via the context that
+// reaches resolveBatched. siblingCount is how many sibling field
+// invocations the resolver framework already knows will call load for this
+// same batched field within reqID (e.g. the number of parent nodes a list
+// field is being resolved for). When opts.Window is zero - the default,
+// "one outbound call per GraphQL request" case - load flushes reqID's
+// bucket as soon as its siblingCount-th caller has enqueued, rather than
+// racing a zero-delay timer against the remaining siblings, and without
+// waiting on or touching any other request's bucket. When opts.Window is
+// non-zero, siblingCount is ignored and a wall-clock timer flushes every
+// bucket together instead, since coalescing across concurrent requests
+// means the total number of callers isn't known up front.
+func (b *batcher) load(reqID string, vars map[string]interface{}, siblingCount int) (interface{}, error) {
+	resultCh := make(chan batchResult, 1)
+
+	b.mu.Lock()
+	b.queued[reqID] = append(b.queued[reqID], batchKey{vars: vars, result: resultCh})
+	switch {
+	case b.opts.Window > 0:
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.opts.Window, b.flushAll)
+		}
+		b.mu.Unlock()
+	case len(b.queued[reqID]) >= siblingCount:
+		// Every sibling this request knows about has called load - flush
+		// just this request's bucket now, synchronously with this call, so
+		// there is no window during which a sibling could still be in
+		// flight, and no risk of mixing in another request's entries.
+		b.mu.Unlock()
+		b.flushRequest(reqID)
+	default:
+		b.mu.Unlock()
+	}
+
+	res := <-resultCh
+	return res.val, res.err
+}
+
+// flushRequest runs the outbound call for everything reqID has queued
+// since its last flush, leaving every other request's bucket untouched.
+func (b *batcher) flushRequest(reqID string) {
+	b.mu.Lock()
+	queued := b.queued[reqID]
+	delete(b.queued, reqID)
+	b.mu.Unlock()
+
+	b.dispatch(queued)
+}
+
+// flushAll runs the outbound call for everything queued across every
+// request's bucket - the opts.Window > 0 path, where coalescing across
+// concurrent requests is the intended behavior.
+func (b *batcher) flushAll() {
+	b.mu.Lock()
+	var queued []batchKey
+	for reqID, rq := range b.queued {
+		queued = append(queued, rq...)
+		delete(b.queued, reqID)
+	}
+	b.timer = nil
+	b.mu.Unlock()
+
+	b.dispatch(queued)
+}
+
+// dispatch applies groupBy/dedupe to queued and calls send, then
+// demultiplexes each result back to its waiting caller by index.
+func (b *batcher) dispatch(queued []batchKey) {
+	if len(queued) == 0 {
+		return
+	}
+
+	entries := make([]map[string]interface{}, 0, len(queued))
+	// groupKey -> index into entries, used for both groupBy and dedupe.
+	entryIndex := map[string]int{}
+	// callerEntry maps each queued caller to the entries index whose
+	// result it should receive.
+	callerEntry := make([]int, len(queued))
+
+	for i, q := range queued {
+		key := ""
+		if b.opts.GroupBy != "" {
+			if v, ok := q.vars[b.opts.GroupBy]; ok {
+				key, _ = toComparableKey(v)
+			}
+		} else if b.opts.Dedupe {
+			key = dedupeKey(q.vars)
+		}
+
+		if key != "" {
+			if idx, ok := entryIndex[key]; ok {
+				callerEntry[i] = idx
+				continue
+			}
+		}
+
+		idx := len(entries)
+		entries = append(entries, q.vars)
+		callerEntry[i] = idx
+		if key != "" {
+			entryIndex[key] = idx
+		}
+	}
+
+	results, err := b.send(entries)
+	for i, q := range queued {
+		if err != nil {
+			q.result <- batchResult{err: err}
+			continue
+		}
+		idx := callerEntry[i]
+		if idx >= len(results) {
+			q.result <- batchResult{err: errors.Errorf(
+				"batched call returned %d results for %d entries", len(results), len(entries))}
+			continue
+		}
+		q.result <- batchResult{val: results[idx]}
+	}
+}
+
+// toComparableKey renders v as a string suitable for grouping/dedupe
+// comparison, alongside whether v was a scalar toComparableKey knows how to
+// render at all. A numeric uid or id field is exactly the kind of value
+// groupBy/dedupe are used on, so ints, floats and bools are supported
+// alongside strings; anything else (nil, a nested map or slice) reports
+// ok == false rather than silently colliding on an empty key.
+func toComparableKey(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	default:
+		return "", false
+	}
+}
+
+// dedupeKey builds a stable string key for an entire vars map so that two
+// parents with identical template variables collapse to one outbound
+// entry. If any var is not a scalar, the entry gets the empty key and is
+// never deduped, rather than risking a false match.
+func dedupeKey(vars map[string]interface{}) string {
+	key := ""
+	for _, k := range sortedKeys(vars) {
+		s, ok := toComparableKey(vars[k])
+		if !ok {
+			return "" // non-scalar value present; don't attempt to dedupe
+		}
+		key += k + "=" + s + ";"
+	}
+	return key
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
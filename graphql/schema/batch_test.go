@@ -0,0 +1,259 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatcher_CoalescesConcurrentCalls(t *testing.T) {
+	var calls int
+	var mu sync.Mutex
+	send := func(vars []map[string]interface{}) ([]interface{}, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		res := make([]interface{}, len(vars))
+		for i, v := range vars {
+			res[i] = "uname-" + v["uid"].(string)
+		}
+		return res, nil
+	}
+
+	b := newBatcher(batchOptions{Window: 20 * time.Millisecond}, send)
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 3)
+	uids := []string{"0x1", "0x2", "0x3"}
+	for i, uid := range uids {
+		wg.Add(1)
+		go func(i int, uid string) {
+			defer wg.Done()
+			v, err := b.load("req1", map[string]interface{}{"uid": uid}, len(uids))
+			require.NoError(t, err)
+			results[i] = v
+		}(i, uid)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 1, calls, "all three loads should have been coalesced into one outbound call")
+	require.Equal(t, []interface{}{"uname-0x1", "uname-0x2", "uname-0x3"}, results)
+}
+
+// TestBatcher_DefaultWindowFlushesOnLastSibling exercises the default
+// (opts.Window == 0) path: it must not flush until every one of the
+// siblingCount callers has enqueued, however the goroutines interleave. A
+// timer-based implementation would be racy here - run with -race to catch
+// a flush that fires before all siblings are queued.
+func TestBatcher_DefaultWindowFlushesOnLastSibling(t *testing.T) {
+	const siblings = 8
+	for iter := 0; iter < 20; iter++ {
+		var calls int32
+		send := func(vars []map[string]interface{}) ([]interface{}, error) {
+			calls++
+			require.Equal(t, siblings, len(vars), "must see every sibling in the single outbound call")
+			res := make([]interface{}, len(vars))
+			for i := range vars {
+				res[i] = "ok"
+			}
+			return res, nil
+		}
+
+		b := newBatcher(batchOptions{}, send)
+
+		var wg sync.WaitGroup
+		for i := 0; i < siblings; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := b.load("req1", map[string]interface{}{"uid": i}, siblings)
+				require.NoError(t, err)
+			}(i)
+		}
+		wg.Wait()
+
+		require.EqualValues(t, 1, calls, "siblings must be coalesced into exactly one outbound call")
+	}
+}
+
+func TestBatcher_Dedupe(t *testing.T) {
+	var sentEntries int
+	send := func(vars []map[string]interface{}) ([]interface{}, error) {
+		sentEntries = len(vars)
+		res := make([]interface{}, len(vars))
+		for i := range vars {
+			res[i] = "ok"
+		}
+		return res, nil
+	}
+
+	b := newBatcher(batchOptions{Window: 20 * time.Millisecond, Dedupe: true}, send)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := b.load("req1", map[string]interface{}{"uid": "0x1"}, 2)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 1, sentEntries, "duplicate keys should be sent only once")
+}
+
+// TestBatcher_ConcurrentRequestsDoNotInterleave is the regression case for
+// two concurrent GraphQL requests sharing one batched field: each request
+// has its own siblingCount and must flush against only its own entries,
+// never a mix of both requests' incomplete queues.
+func TestBatcher_ConcurrentRequestsDoNotInterleave(t *testing.T) {
+	for iter := 0; iter < 20; iter++ {
+		var mu sync.Mutex
+		var callSizes []int
+		send := func(vars []map[string]interface{}) ([]interface{}, error) {
+			mu.Lock()
+			callSizes = append(callSizes, len(vars))
+			mu.Unlock()
+			res := make([]interface{}, len(vars))
+			for i := range vars {
+				res[i] = "ok"
+			}
+			return res, nil
+		}
+
+		b := newBatcher(batchOptions{}, send)
+
+		var wg sync.WaitGroup
+		// req1 has 2 siblings, req2 has 5 - if the queue were shared,
+		// req1's threshold of 2 could be reached by a mix of req1 and
+		// req2 entries.
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := b.load("req1", map[string]interface{}{"uid": i}, 2)
+				require.NoError(t, err)
+			}(i)
+		}
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := b.load("req2", map[string]interface{}{"uid": i}, 5)
+				require.NoError(t, err)
+			}(i)
+		}
+		wg.Wait()
+
+		mu.Lock()
+		sizes := append([]int(nil), callSizes...)
+		mu.Unlock()
+
+		require.Len(t, sizes, 2, "each request must flush as its own outbound call")
+		require.ElementsMatch(t, []int{2, 5}, sizes, "neither call may mix in the other request's entries")
+	}
+}
+
+func TestBatcher_GroupBy(t *testing.T) {
+	var sentEntries int
+	send := func(vars []map[string]interface{}) ([]interface{}, error) {
+		sentEntries = len(vars)
+		res := make([]interface{}, len(vars))
+		for i := range vars {
+			res[i] = "ok"
+		}
+		return res, nil
+	}
+
+	b := newBatcher(batchOptions{Window: 20 * time.Millisecond, GroupBy: "schoolId"}, send)
+
+	var wg sync.WaitGroup
+	schoolIDs := []string{"s1", "s1", "s2"}
+	for _, id := range schoolIDs {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			_, err := b.load("req1", map[string]interface{}{"schoolId": id, "uid": "0x1"}, len(schoolIDs))
+			require.NoError(t, err)
+		}(id)
+	}
+	wg.Wait()
+
+	require.Equal(t, 2, sentEntries, "parents sharing a groupBy value should collapse into one entry")
+}
+
+// TestBatcher_GroupByNumericKey is the regression case for a numeric
+// groupBy field (e.g. a uid or id) - toComparableKey must render it into a
+// real key rather than silently disabling coalescing for the entry.
+func TestBatcher_GroupByNumericKey(t *testing.T) {
+	var sentEntries int
+	send := func(vars []map[string]interface{}) ([]interface{}, error) {
+		sentEntries = len(vars)
+		res := make([]interface{}, len(vars))
+		for i := range vars {
+			res[i] = "ok"
+		}
+		return res, nil
+	}
+
+	b := newBatcher(batchOptions{Window: 20 * time.Millisecond, GroupBy: "schoolId"}, send)
+
+	var wg sync.WaitGroup
+	schoolIDs := []int64{1, 1, 2}
+	for _, id := range schoolIDs {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			_, err := b.load("req1", map[string]interface{}{"schoolId": id, "uid": "0x1"}, len(schoolIDs))
+			require.NoError(t, err)
+		}(id)
+	}
+	wg.Wait()
+
+	require.Equal(t, 2, sentEntries, "parents sharing a numeric groupBy value should collapse into one entry")
+}
+
+func TestToComparableKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     interface{}
+		want   string
+		wantOK bool
+	}{
+		{"string", "0x1", "0x1", true},
+		{"bool", true, "true", true},
+		{"int", 7, "7", true},
+		{"int64", int64(7), "7", true},
+		{"float64", float64(7), "7", true},
+		{"nil", nil, "", false},
+		{"map", map[string]interface{}{"a": 1}, "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := toComparableKey(tc.in)
+			require.Equal(t, tc.wantOK, ok)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
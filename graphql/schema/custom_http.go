@@ -0,0 +1,412 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// customHTTPOptionsFromDirective reads the optional timeoutMs/retry/
+// circuitBreaker arguments off a @custom(http: {...}) directive's `http`
+// argument value and turns them into the structs doCustomHTTPRequest
+// understands. Any of the three may be absent, in which case that part of
+// customHTTPCallOptions is left at its zero value (no timeout, a single
+// attempt, no breaker).
+func customHTTPOptionsFromDirective(httpArg *ast.ChildValue, method, urlTemplate string) (customHTTPCallOptions, error) {
+	opts := customHTTPCallOptions{Method: method, URLTemplate: urlTemplate}
+	if httpArg == nil || httpArg.Value == nil {
+		return opts, nil
+	}
+
+	for _, c := range httpArg.Value.Children {
+		switch c.Name {
+		case "timeoutMs":
+			n, err := c.Value.Value(nil)
+			if err != nil {
+				return opts, errors.Wrap(err, "while reading timeoutMs")
+			}
+			ms, err := toInt(n)
+			if err != nil {
+				return opts, errors.Wrap(err, "timeoutMs must be an integer")
+			}
+			opts.TimeoutMs = ms
+		case "retry":
+			rc, err := parseRetryConfig(c.Value.Children)
+			if err != nil {
+				return opts, err
+			}
+			opts.Retry = rc
+		case "circuitBreaker":
+			cb, err := parseCircuitBreakerConfig(c.Value.Children)
+			if err != nil {
+				return opts, err
+			}
+			opts.CircuitBreaker = cb
+		}
+	}
+	return opts, nil
+}
+
+func parseRetryConfig(children ast.ChildValueList) (*retryConfig, error) {
+	rc := &retryConfig{On: map[string]bool{}}
+	for _, c := range children {
+		switch c.Name {
+		case "attempts":
+			v, err := c.Value.Value(nil)
+			if err != nil {
+				return nil, errors.Wrap(err, "while reading retry.attempts")
+			}
+			n, err := toInt(v)
+			if err != nil {
+				return nil, errors.Wrap(err, "retry.attempts must be an integer")
+			}
+			rc.Attempts = n
+		case "backoffMs":
+			v, err := c.Value.Value(nil)
+			if err != nil {
+				return nil, errors.Wrap(err, "while reading retry.backoffMs")
+			}
+			n, err := toInt(v)
+			if err != nil {
+				return nil, errors.Wrap(err, "retry.backoffMs must be an integer")
+			}
+			rc.BackoffMs = n
+		case "on":
+			for _, elem := range c.Value.Children {
+				v, err := elem.Value.Value(nil)
+				if err != nil {
+					return nil, errors.Wrap(err, "while reading retry.on")
+				}
+				s, _ := v.(string)
+				rc.On[s] = true
+			}
+		}
+	}
+	return rc, nil
+}
+
+func parseCircuitBreakerConfig(children ast.ChildValueList) (*circuitBreakerConfig, error) {
+	cb := &circuitBreakerConfig{}
+	for _, c := range children {
+		v, err := c.Value.Value(nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading circuitBreaker.%s", c.Name)
+		}
+		n, err := toInt(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "circuitBreaker.%s must be an integer", c.Name)
+		}
+		switch c.Name {
+		case "failureThreshold":
+			cb.FailureThreshold = n
+		case "cooldownMs":
+			cb.CooldownMs = n
+		}
+	}
+	return cb, nil
+}
+
+func toInt(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case int64:
+		return int(n), nil
+	case int:
+		return n, nil
+	case float64:
+		return int(n), nil
+	default:
+		return 0, errors.Errorf("expected an integer, got %T", v)
+	}
+}
+
+// retryConfig is the parsed form of a @custom(http: {retry: {...}})
+// argument.
+type retryConfig struct {
+	Attempts  int
+	BackoffMs int
+	// On is the set of failure classes that should trigger a retry - the
+	// directive accepts "5xx" and "network".
+	On map[string]bool
+}
+
+// circuitBreakerConfig is the parsed form of a
+// @custom(http: {circuitBreaker: {...}}) argument.
+type circuitBreakerConfig struct {
+	FailureThreshold int
+	CooldownMs       int
+}
+
+// customHTTPCallOptions bundles the per-endpoint settings the directive
+// parser extracts from timeoutMs/retry/circuitBreaker, alongside the method
+// and URL template that key the shared circuit breaker.
+type customHTTPCallOptions struct {
+	Method         string
+	URLTemplate    string
+	TimeoutMs      int
+	Retry          *retryConfig
+	CircuitBreaker *circuitBreakerConfig
+}
+
+// httpCallMetrics are the counters surfaced for @custom HTTP calls
+// (attempts, breaker opens, timeouts). They're plain counters here so that
+// whatever metrics package wraps this (e.g. an expvar or Prometheus
+// exporter elsewhere in the codebase) can read and reset them without this
+// file needing to know about it.
+type httpCallMetrics struct {
+	mu       sync.Mutex
+	Attempts int64
+	Opens    int64
+	Timeouts int64
+}
+
+func (m *httpCallMetrics) incAttempts() {
+	m.mu.Lock()
+	m.Attempts++
+	m.mu.Unlock()
+}
+
+func (m *httpCallMetrics) incOpens() {
+	m.mu.Lock()
+	m.Opens++
+	m.mu.Unlock()
+}
+
+func (m *httpCallMetrics) incTimeouts() {
+	m.mu.Lock()
+	m.Timeouts++
+	m.mu.Unlock()
+}
+
+// customHTTPMetrics is the process-wide counter set surfaced by the
+// @custom HTTP resolver.
+var customHTTPMetrics = &httpCallMetrics{}
+
+// breakerState is one of closed, open or half-open, following the standard
+// circuit breaker state machine.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker trips open after consecutiveFailures reaches
+// failureThreshold, rejecting calls until cooldown has elapsed, at which
+// point it allows a single trial call through (half-open) to decide whether
+// to close again or re-open.
+type circuitBreaker struct {
+	mu                  sync.Mutex
+	failureThreshold    int
+	cooldown            time.Duration
+	state               breakerState
+	consecutiveFailures int
+	openedAt            time.Time
+}
+
+// circuitBreakers is the process-wide registry of breakers, keyed by
+// "METHOD url-template" so that every call site for a given @custom field
+// shares the same breaker.
+var (
+	circuitBreakersMu sync.Mutex
+	circuitBreakers   = map[string]*circuitBreaker{}
+)
+
+func breakerFor(key string, cfg *circuitBreakerConfig) *circuitBreaker {
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+	cb, ok := circuitBreakers[key]
+	if !ok {
+		cb = &circuitBreaker{
+			failureThreshold: cfg.FailureThreshold,
+			cooldown:         time.Duration(cfg.CooldownMs) * time.Millisecond,
+		}
+		circuitBreakers[key] = cb
+	}
+	return cb
+}
+
+// allow reports whether a call should be let through, transitioning the
+// breaker from open to half-open once the cooldown has elapsed.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Since(cb.openedAt) >= cb.cooldown {
+			cb.state = breakerHalfOpen
+			return true
+		}
+		return false
+	default: // breakerHalfOpen: the trial call is already in flight
+		return false
+	}
+}
+
+func (cb *circuitBreaker) recordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.state = breakerClosed
+	cb.consecutiveFailures = 0
+}
+
+// recordFailure reports whether this failure just tripped the breaker open.
+func (cb *circuitBreaker) recordFailure() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == breakerHalfOpen {
+		cb.state = breakerOpen
+		cb.openedAt = time.Now()
+		return true
+	}
+	cb.consecutiveFailures++
+	if cb.consecutiveFailures >= cb.failureThreshold {
+		cb.state = breakerOpen
+		cb.openedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+// errCircuitOpen is returned by doCustomHTTPRequest when the breaker for an
+// endpoint is open (or half-open with its trial call already let through)
+// and the call is rejected without being attempted.
+var errCircuitOpen = errors.New("circuit breaker open for this endpoint")
+
+// isRetryableStatus reports whether a response status code falls in the
+// "5xx" class the retry directive can be configured to retry on.
+func isRetryableStatus(code int) bool {
+	return code >= 500 && code < 600
+}
+
+// isSuccessStatus reports whether a response status code is a 2xx or 3xx -
+// the classes a circuit breaker should treat as a healthy call regardless
+// of whether retry.on covers "5xx".
+func isSuccessStatus(code int) bool {
+	return code >= 200 && code < 400
+}
+
+// backoffWithJitter returns how long to wait before attempt (1-indexed),
+// using exponential backoff off of baseMs with +/-50% jitter so that
+// concurrent callers retrying the same endpoint don't all wake up in sync.
+func backoffWithJitter(baseMs int, attempt int) time.Duration {
+	backoff := float64(baseMs) * float64(uint(1)<<uint(attempt-1))
+	jitter := backoff * (0.5 + rand.Float64())
+	return time.Duration(jitter) * time.Millisecond
+}
+
+// doCustomHTTPRequest issues req, honoring opts' timeout, retry and circuit
+// breaker settings. send is the actual transport call (injected so tests
+// don't need a real listener); in production it is http.DefaultClient.Do.
+func doCustomHTTPRequest(
+	ctx context.Context,
+	req *http.Request,
+	opts customHTTPCallOptions,
+	send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+
+	if opts.TimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(opts.TimeoutMs)*time.Millisecond)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	var cb *circuitBreaker
+	breakerKey := opts.Method + " " + opts.URLTemplate
+	if opts.CircuitBreaker != nil {
+		cb = breakerFor(breakerKey, opts.CircuitBreaker)
+		if !cb.allow() {
+			return nil, errCircuitOpen
+		}
+	}
+
+	attempts := 1
+	var backoffMs int
+	var retryOn map[string]bool
+	if opts.Retry != nil {
+		attempts = opts.Retry.Attempts
+		backoffMs = opts.Retry.BackoffMs
+		retryOn = opts.Retry.On
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		customHTTPMetrics.incAttempts()
+		resp, err := send(req)
+
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			customHTTPMetrics.incTimeouts()
+		}
+
+		// Only a 5xx with retry.on containing "5xx" - or a transport error
+		// with retry.on containing "network" - counts as retryable. With
+		// no retry config at all (the default for every @custom field that
+		// doesn't opt in), nothing is retryable: a 5xx response is handed
+		// straight back to the caller to interpret, exactly as it always
+		// was before retries existed.
+		retryable := (err != nil && retryOn["network"]) ||
+			(err == nil && retryOn["5xx"] && isRetryableStatus(resp.StatusCode))
+
+		if !retryable {
+			if cb != nil {
+				// A breaker protects against a dependency that's unhealthy,
+				// not against the caller's retry policy - a non-2xx/3xx
+				// response counts as a failure for breaker purposes even
+				// when retry.on doesn't cover "5xx" (or there's no retry
+				// config at all), otherwise a consistently-failing
+				// dependency never trips the breaker unless the caller
+				// separately opted into 5xx retries.
+				if err != nil || !isSuccessStatus(resp.StatusCode) {
+					if cb.recordFailure() {
+						customHTTPMetrics.incOpens()
+					}
+				} else {
+					cb.recordSuccess()
+				}
+			}
+			return resp, err
+		}
+
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = errors.Errorf("received retryable status code: %d", resp.StatusCode)
+		}
+
+		if attempt == attempts {
+			if cb != nil && cb.recordFailure() {
+				customHTTPMetrics.incOpens()
+			}
+			return resp, lastErr
+		}
+
+		time.Sleep(backoffWithJitter(backoffMs, attempt))
+	}
+	return nil, lastErr
+}
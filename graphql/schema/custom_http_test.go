@@ -0,0 +1,196 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoCustomHTTPRequest_RetriesOnNetworkError(t *testing.T) {
+	calls := 0
+	send := func(req *http.Request) (*http.Response, error) {
+		calls++
+		if calls < 3 {
+			return nil, errors.New("connection reset")
+		}
+		return &http.Response{StatusCode: 200}, nil
+	}
+
+	opts := customHTTPCallOptions{
+		Method:      "GET",
+		URLTemplate: "http://example.com/x",
+		Retry:       &retryConfig{Attempts: 3, BackoffMs: 1, On: map[string]bool{"network": true}},
+	}
+	resp, err := doCustomHTTPRequest(context.Background(), &http.Request{}, opts, send)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, 3, calls)
+}
+
+func TestDoCustomHTTPRequest_GivesUpAfterMaxAttempts(t *testing.T) {
+	calls := 0
+	send := func(req *http.Request) (*http.Response, error) {
+		calls++
+		return nil, errors.New("connection reset")
+	}
+
+	opts := customHTTPCallOptions{
+		Method:      "GET",
+		URLTemplate: "http://example.com/y",
+		Retry:       &retryConfig{Attempts: 2, BackoffMs: 1, On: map[string]bool{"network": true}},
+	}
+	_, err := doCustomHTTPRequest(context.Background(), &http.Request{}, opts, send)
+	require.Error(t, err)
+	require.Equal(t, 2, calls)
+}
+
+func TestDoCustomHTTPRequest_5xxWithoutRetryConfigIsNotAnError(t *testing.T) {
+	calls := 0
+	send := func(req *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: 503}, nil
+	}
+
+	opts := customHTTPCallOptions{Method: "GET", URLTemplate: "http://example.com/no-retry"}
+	resp, err := doCustomHTTPRequest(context.Background(), &http.Request{}, opts, send)
+	require.NoError(t, err)
+	require.Equal(t, 503, resp.StatusCode)
+	require.Equal(t, 1, calls, "an unconfigured 5xx must not be retried")
+}
+
+func TestDoCustomHTTPRequest_5xxNotInRetryOnIsNotAnError(t *testing.T) {
+	calls := 0
+	send := func(req *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: 503}, nil
+	}
+
+	opts := customHTTPCallOptions{
+		Method:      "GET",
+		URLTemplate: "http://example.com/network-only",
+		Retry:       &retryConfig{Attempts: 3, BackoffMs: 1, On: map[string]bool{"network": true}},
+	}
+	resp, err := doCustomHTTPRequest(context.Background(), &http.Request{}, opts, send)
+	require.NoError(t, err)
+	require.Equal(t, 503, resp.StatusCode)
+	require.Equal(t, 1, calls, "a 5xx must not be retried unless retry.on includes \"5xx\"")
+}
+
+func TestDoCustomHTTPRequest_RetriesOn5xxWhenConfigured(t *testing.T) {
+	calls := 0
+	send := func(req *http.Request) (*http.Response, error) {
+		calls++
+		if calls < 2 {
+			return &http.Response{StatusCode: 503}, nil
+		}
+		return &http.Response{StatusCode: 200}, nil
+	}
+
+	opts := customHTTPCallOptions{
+		Method:      "GET",
+		URLTemplate: "http://example.com/5xx-retry",
+		Retry:       &retryConfig{Attempts: 2, BackoffMs: 1, On: map[string]bool{"5xx": true}},
+	}
+	resp, err := doCustomHTTPRequest(context.Background(), &http.Request{}, opts, send)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, 2, calls)
+}
+
+func TestDoCustomHTTPRequest_5xxErrorsOnceRetriesExhausted(t *testing.T) {
+	calls := 0
+	send := func(req *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: 503}, nil
+	}
+
+	opts := customHTTPCallOptions{
+		Method:      "GET",
+		URLTemplate: "http://example.com/5xx-exhausted",
+		Retry:       &retryConfig{Attempts: 2, BackoffMs: 1, On: map[string]bool{"5xx": true}},
+	}
+	resp, err := doCustomHTTPRequest(context.Background(), &http.Request{}, opts, send)
+	require.Error(t, err)
+	require.Equal(t, 503, resp.StatusCode)
+	require.Equal(t, 2, calls)
+}
+
+func TestCircuitBreaker_OpensAfterThreshold(t *testing.T) {
+	circuitBreakersMu.Lock()
+	circuitBreakers = map[string]*circuitBreaker{}
+	circuitBreakersMu.Unlock()
+
+	calls := 0
+	send := func(req *http.Request) (*http.Response, error) {
+		calls++
+		return nil, errors.New("boom")
+	}
+
+	opts := customHTTPCallOptions{
+		Method:         "GET",
+		URLTemplate:    "http://example.com/z",
+		Retry:          &retryConfig{Attempts: 1, On: map[string]bool{"network": true}},
+		CircuitBreaker: &circuitBreakerConfig{FailureThreshold: 2, CooldownMs: 100000},
+	}
+
+	_, err := doCustomHTTPRequest(context.Background(), &http.Request{}, opts, send)
+	require.Error(t, err)
+	_, err = doCustomHTTPRequest(context.Background(), &http.Request{}, opts, send)
+	require.Error(t, err)
+	require.Equal(t, 2, calls)
+
+	// breaker should now be open and reject without calling send again.
+	_, err = doCustomHTTPRequest(context.Background(), &http.Request{}, opts, send)
+	require.Equal(t, errCircuitOpen, err)
+	require.Equal(t, 2, calls)
+}
+
+func TestCircuitBreaker_OpensOn5xxWithoutRetryConfigured(t *testing.T) {
+	circuitBreakersMu.Lock()
+	circuitBreakers = map[string]*circuitBreaker{}
+	circuitBreakersMu.Unlock()
+
+	calls := 0
+	send := func(req *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: 503}, nil
+	}
+
+	opts := customHTTPCallOptions{
+		Method:         "GET",
+		URLTemplate:    "http://example.com/always-503",
+		CircuitBreaker: &circuitBreakerConfig{FailureThreshold: 2, CooldownMs: 100000},
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := doCustomHTTPRequest(context.Background(), &http.Request{}, opts, send)
+		require.NoError(t, err, "an unconfigured 5xx is still handed back, not turned into an error")
+		require.Equal(t, 503, resp.StatusCode)
+	}
+	require.Equal(t, 2, calls)
+
+	// A dependency that consistently 500s must trip the breaker even
+	// though nothing opted into retrying on "5xx".
+	_, err := doCustomHTTPRequest(context.Background(), &http.Request{}, opts, send)
+	require.Equal(t, errCircuitOpen, err)
+	require.Equal(t, 2, calls)
+}
@@ -0,0 +1,316 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// requestIDCtxKey is the context key the resolver framework tags a
+// GraphQL request with so that resolveBatched can key its batcher's
+// per-request queue off it - see batcher's doc comment for why that
+// partitioning matters.
+type requestIDCtxKey struct{}
+
+// WithRequestID returns a context tagged with reqID, the per-GraphQL-
+// request identifier resolveBatched keys its batching on. The resolver
+// framework that dispatches @custom fields is expected to call this once
+// per incoming GraphQL request and pass the result down to every field
+// resolver.
+func WithRequestID(ctx context.Context, reqID string) context.Context {
+	return context.WithValue(ctx, requestIDCtxKey{}, reqID)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDCtxKey{}).(string)
+	return id
+}
+
+// customHTTPFieldConfig is everything customHTTPFieldResolver needs to
+// serve one @custom(http: {...}) field: the call options
+// customHTTPOptionsFromDirective already understood (timeout/retry/
+// circuitBreaker), plus the url/body templates and batching mode that tie
+// this package's pieces - the directive parser, the URL/body evaluator and
+// doCustomHTTPRequest/batcher - into the single path an actual resolver
+// dispatcher calls per field.
+type customHTTPFieldConfig struct {
+	opts         customHTTPCallOptions
+	bodyTemplate string // "" for fields with no request body (GET, mostly)
+	mode         string // "SINGLE" (default) or "BATCH"
+	batch        batchOptions
+}
+
+// customHTTPFieldConfigFromDirective parses a @custom(http: {...}) directive's
+// `http` argument in full: url, method and body templates and the
+// mode/groupBy/dedupe batching settings, alongside the
+// timeout/retry/circuitBreaker settings customHTTPOptionsFromDirective
+// already handles.
+func customHTTPFieldConfigFromDirective(httpArg *ast.ChildValue) (customHTTPFieldConfig, error) {
+	var cfg customHTTPFieldConfig
+	cfg.mode = "SINGLE"
+	if httpArg == nil || httpArg.Value == nil {
+		return cfg, errors.New("@custom(http: ...) directive is missing its http argument")
+	}
+
+	var method, urlTemplate string
+	for _, c := range httpArg.Value.Children {
+		switch c.Name {
+		case "url":
+			v, err := c.Value.Value(nil)
+			if err != nil {
+				return cfg, errors.Wrap(err, "while reading url")
+			}
+			urlTemplate, _ = v.(string)
+		case "method":
+			v, err := c.Value.Value(nil)
+			if err != nil {
+				return cfg, errors.Wrap(err, "while reading method")
+			}
+			method, _ = v.(string)
+		case "body":
+			v, err := c.Value.Value(nil)
+			if err != nil {
+				return cfg, errors.Wrap(err, "while reading body")
+			}
+			cfg.bodyTemplate, _ = v.(string)
+		case "mode":
+			v, err := c.Value.Value(nil)
+			if err != nil {
+				return cfg, errors.Wrap(err, "while reading mode")
+			}
+			if s, ok := v.(string); ok && s != "" {
+				cfg.mode = s
+			}
+		case "groupBy":
+			v, err := c.Value.Value(nil)
+			if err != nil {
+				return cfg, errors.Wrap(err, "while reading groupBy")
+			}
+			cfg.batch.GroupBy, _ = v.(string)
+		case "dedupe":
+			v, err := c.Value.Value(nil)
+			if err != nil {
+				return cfg, errors.Wrap(err, "while reading dedupe")
+			}
+			cfg.batch.Dedupe, _ = v.(bool)
+		}
+	}
+	if method == "" {
+		return cfg, errors.New("@custom(http: ...) directive is missing method")
+	}
+	if urlTemplate == "" {
+		return cfg, errors.New("@custom(http: ...) directive is missing url")
+	}
+
+	opts, err := customHTTPOptionsFromDirective(httpArg, method, urlTemplate)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.opts = opts
+	return cfg, nil
+}
+
+// customHTTPFieldResolver dispatches every call to one @custom(http: {...})
+// field: it builds the request from cfg and vars, issues it (batching
+// alongside concurrent calls for the same field when cfg.mode is "BATCH"),
+// and returns the decoded JSON response body.
+//
+// This is the resolver dispatch path the directive parser, URL/body
+// templating and doCustomHTTPRequest/batcher were built to serve; nothing
+// in this snapshot's resolver execution engine calls it yet (that engine
+// isn't part of this tree), but it's the single, real, tested function such
+// a dispatcher would call per field.
+type customHTTPFieldResolver struct {
+	cfg  customHTTPFieldConfig
+	send func(*http.Request) (*http.Response, error)
+
+	mu      sync.Mutex
+	batcher *batcher
+}
+
+// newCustomHTTPFieldResolver builds a resolver for one field's directive
+// config. send is the transport call (http.DefaultClient.Do in production,
+// a fake in tests).
+func newCustomHTTPFieldResolver(cfg customHTTPFieldConfig, send func(*http.Request) (*http.Response, error)) *customHTTPFieldResolver {
+	return &customHTTPFieldResolver{cfg: cfg, send: send}
+}
+
+// resolve evaluates the field for one parent's vars. ctx carries the
+// request identifier resolveBatched partitions its batcher's queue on (see
+// WithRequestID); siblingCount is the number of sibling invocations of
+// this field the caller already knows will happen within the current
+// GraphQL request - the same contract batcher.load documents. Both are
+// ignored outside of BATCH mode.
+func (r *customHTTPFieldResolver) resolve(ctx context.Context, vars map[string]interface{}, siblingCount int) (interface{}, error) {
+	if r.cfg.mode == "BATCH" {
+		return r.resolveBatched(ctx, vars, siblingCount)
+	}
+	return r.resolveOne(vars)
+}
+
+// resolveBatched routes vars through the shared batcher for this field,
+// created lazily on first use so every caller of this resolver shares one
+// batcher - which itself keeps each GraphQL request's queued parents in
+// its own bucket, keyed by the request ID ctx carries - whose outbound
+// call is sendBatch: exactly one HTTP call per flush, not one per parent.
+func (r *customHTTPFieldResolver) resolveBatched(ctx context.Context, vars map[string]interface{}, siblingCount int) (interface{}, error) {
+	r.mu.Lock()
+	if r.batcher == nil {
+		r.batcher = newBatcher(r.cfg.batch, r.sendBatch)
+	}
+	b := r.batcher
+	r.mu.Unlock()
+
+	return b.load(requestIDFromContext(ctx), vars, siblingCount)
+}
+
+// resolveOne issues the single outbound HTTP call for one parent's vars -
+// the SINGLE mode path (the default, and every non-batched call).
+func (r *customHTTPFieldResolver) resolveOne(vars map[string]interface{}) (interface{}, error) {
+	req, err := r.buildRequest(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := doCustomHTTPRequest(req.Context(), req, r.cfg.opts, r.send)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var val interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&val); err != nil {
+		return nil, errors.Wrap(err, "while decoding @custom HTTP response body")
+	}
+	return val, nil
+}
+
+// sendBatch is the batcher's send callback: it issues exactly one outbound
+// HTTP call for every parent queued since the last flush, with the request
+// body as a JSON array of their per-parent bodyTemplate entries - the
+// "array of parents in, array of results out" protocol userNamesHandler,
+// teacherNamesHandler and friends in graphql/e2e/custom_logic/cmd already
+// speak - and decodes the response the same way: one JSON array entry per
+// parent, in the same order.
+func (r *customHTTPFieldResolver) sendBatch(parents []map[string]interface{}) ([]interface{}, error) {
+	req, err := r.buildBatchRequest(parents)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := doCustomHTTPRequest(req.Context(), req, r.cfg.opts, r.send)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var results []interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, errors.Wrap(err, "while decoding batched @custom HTTP response body")
+	}
+	return results, nil
+}
+
+// buildRequest evaluates cfg's url/body templates against vars - via the
+// same substituteVarsInURL/parseBodyTemplate/substituteVarsInBody functions
+// wrappers_test.go already specifies the behavior of - and turns the result
+// into a real *http.Request for a single parent.
+func (r *customHTTPFieldResolver) buildRequest(vars map[string]interface{}) (*http.Request, error) {
+	url, err := substituteVarsInURL(r.cfg.opts.URLTemplate, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := r.bodyEntry(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	var bodyReader *bytes.Reader
+	if entry != nil {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return nil, errors.Wrap(err, "while marshaling @custom HTTP request body")
+		}
+		bodyReader = bytes.NewReader(b)
+	} else {
+		bodyReader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(r.cfg.opts.Method, url, bodyReader)
+	if err != nil {
+		return nil, errors.Wrap(err, "while building @custom HTTP request")
+	}
+	if entry != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// buildBatchRequest builds the single combined request for a BATCH flush:
+// the URL template is evaluated without any parent's vars (a batched
+// endpoint's URL can't depend on a single parent), and the body is a JSON
+// array of each parent's bodyTemplate entry, in order.
+func (r *customHTTPFieldResolver) buildBatchRequest(parents []map[string]interface{}) (*http.Request, error) {
+	url, err := substituteVarsInURL(r.cfg.opts.URLTemplate, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]map[string]interface{}, len(parents))
+	for i, vars := range parents {
+		entry, err := r.bodyEntry(vars)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = entry
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return nil, errors.Wrap(err, "while marshaling batched @custom HTTP request body")
+	}
+
+	req, err := http.NewRequest(r.cfg.opts.Method, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "while building batched @custom HTTP request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// bodyEntry evaluates cfg.bodyTemplate against one parent's vars, or
+// returns nil if the field has no body template (a GET, mostly).
+func (r *customHTTPFieldResolver) bodyEntry(vars map[string]interface{}) (map[string]interface{}, error) {
+	if r.cfg.bodyTemplate == "" {
+		return nil, nil
+	}
+	parsed, _, err := parseBodyTemplate(r.cfg.bodyTemplate)
+	if err != nil {
+		return nil, err
+	}
+	if err := substituteVarsInBody(parsed, vars); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// strVal, boolVal, objVal and childVal build the *ast.Value/*ast.ChildValue
+// tree customHTTPOptionsFromDirective and customHTTPFieldConfigFromDirective
+// read their arguments off, without needing a full schema parse.
+func strVal(s string) *ast.Value { return &ast.Value{Kind: ast.StringValue, Raw: s} }
+
+func boolVal(b bool) *ast.Value {
+	raw := "false"
+	if b {
+		raw = "true"
+	}
+	return &ast.Value{Kind: ast.BooleanValue, Raw: raw}
+}
+
+func objVal(children ...*ast.ChildValue) *ast.Value {
+	return &ast.Value{Kind: ast.ObjectValue, Children: children}
+}
+
+func childVal(name string, v *ast.Value) *ast.ChildValue {
+	return &ast.ChildValue{Name: name, Value: v}
+}
+
+func TestCustomHTTPFieldConfigFromDirective(t *testing.T) {
+	httpArg := childVal("http", objVal(
+		childVal("url", strVal("http://example.com/favMovies/$id")),
+		childVal("method", strVal("GET")),
+		childVal("mode", strVal("BATCH")),
+		childVal("groupBy", strVal("schoolId")),
+	))
+
+	cfg, err := customHTTPFieldConfigFromDirective(httpArg)
+	require.NoError(t, err)
+	require.Equal(t, "GET", cfg.opts.Method)
+	require.Equal(t, "http://example.com/favMovies/$id", cfg.opts.URLTemplate)
+	require.Equal(t, "BATCH", cfg.mode)
+	require.Equal(t, "schoolId", cfg.batch.GroupBy)
+}
+
+func TestCustomHTTPFieldConfigFromDirective_DefaultsToSingleMode(t *testing.T) {
+	httpArg := childVal("http", objVal(
+		childVal("url", strVal("http://example.com/favMovies/$id")),
+		childVal("method", strVal("GET")),
+	))
+
+	cfg, err := customHTTPFieldConfigFromDirective(httpArg)
+	require.NoError(t, err)
+	require.Equal(t, "SINGLE", cfg.mode)
+}
+
+func TestCustomHTTPFieldConfigFromDirective_MissingURL(t *testing.T) {
+	httpArg := childVal("http", objVal(childVal("method", strVal("GET"))))
+	_, err := customHTTPFieldConfigFromDirective(httpArg)
+	require.Error(t, err)
+}
+
+func TestCustomHTTPFieldResolver_ResolveSingle(t *testing.T) {
+	httpArg := childVal("http", objVal(
+		childVal("url", strVal("http://example.com/favMovies/$id")),
+		childVal("method", strVal("GET")),
+	))
+	cfg, err := customHTTPFieldConfigFromDirective(httpArg)
+	require.NoError(t, err)
+
+	var gotURL string
+	send := func(req *http.Request) (*http.Response, error) {
+		gotURL = req.URL.String()
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"name":"Inception"}`)),
+		}, nil
+	}
+
+	r := newCustomHTTPFieldResolver(cfg, send)
+	val, err := r.resolve(context.Background(), map[string]interface{}{"id": "0x1"}, 1)
+	require.NoError(t, err)
+	require.Equal(t, "http://example.com/favMovies/0x1", gotURL)
+	require.Equal(t, map[string]interface{}{"name": "Inception"}, val)
+}
+
+func TestCustomHTTPFieldResolver_ResolveSingleWithBody(t *testing.T) {
+	httpArg := childVal("http", objVal(
+		childVal("url", strVal("http://example.com/favMovies")),
+		childVal("method", strVal("POST")),
+		childVal("body", strVal("{name: $name}")),
+	))
+	cfg, err := customHTTPFieldConfigFromDirective(httpArg)
+	require.NoError(t, err)
+
+	var gotBody string
+	var gotContentType string
+	send := func(req *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(req.Body)
+		gotBody = string(b)
+		gotContentType = req.Header.Get("Content-Type")
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`{"id":"0x2"}`))}, nil
+	}
+
+	r := newCustomHTTPFieldResolver(cfg, send)
+	val, err := r.resolve(context.Background(), map[string]interface{}{"name": "Inception"}, 1)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"Inception"}`, gotBody)
+	require.Equal(t, "application/json", gotContentType)
+	require.Equal(t, map[string]interface{}{"id": "0x2"}, val)
+}
+
+func TestCustomHTTPFieldResolver_ResolveBatchedSharesOneOutboundCall(t *testing.T) {
+	httpArg := childVal("http", objVal(
+		childVal("url", strVal("http://example.com/names/$uid")),
+		childVal("method", strVal("POST")),
+		childVal("body", strVal("{uid: $uid}")),
+		childVal("mode", strVal("BATCH")),
+	))
+	cfg, err := customHTTPFieldConfigFromDirective(httpArg)
+	require.NoError(t, err)
+
+	var calls int
+	var gotBody string
+	send := func(req *http.Request) (*http.Response, error) {
+		calls++
+		b, _ := ioutil.ReadAll(req.Body)
+		gotBody = string(b)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`["uid-0","uid-1"]`))}, nil
+	}
+
+	r := newCustomHTTPFieldResolver(cfg, send)
+
+	results := make(chan interface{}, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			val, err := r.resolve(context.Background(), map[string]interface{}{"uid": i}, 2)
+			require.NoError(t, err)
+			results <- val
+		}(i)
+	}
+	got := []interface{}{<-results, <-results}
+
+	require.Equal(t, 1, calls, "both siblings should have been coalesced into one outbound call")
+	var gotEntries []map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(gotBody), &gotEntries))
+	require.Len(t, gotEntries, 2, "the outbound body should be an array of one entry per parent")
+	require.ElementsMatch(t, []interface{}{"uid-0", "uid-1"}, got, "each caller should receive its own entry of the decoded results array")
+}
@@ -0,0 +1,415 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// introspectionQuery is issued against a @remoteGraphQL endpoint's schema to
+// discover the types and fields it exposes, so they can be merged into the
+// local schema.
+const introspectionQuery = `query IntrospectionQuery {
+	__schema {
+		types {
+			name
+			kind
+			fields { name type { name kind ofType { name kind } } }
+		}
+	}
+}`
+
+// remoteGraphQLDirectivePattern matches a schema-level
+// `@remoteGraphQL(endpoint: "...")` directive. Headers are deliberately not
+// parsed out of the schema text here; callers that need per-endpoint
+// headers pass them straight to ExpandRemoteGraphQLDirectives instead,
+// since header values are usually environment secrets that don't belong in
+// checked-in schema source.
+var remoteGraphQLDirectivePattern = regexp.MustCompile(`@remoteGraphQL\(endpoint:\s*"([^"]+)"\)`)
+
+// remoteField records where a field on a merged type should be dispatched:
+// to the local Dgraph resolver, or forwarded to a remote subgraph.
+type remoteField struct {
+	TypeName  string
+	FieldName string
+	Endpoint  string
+	Headers   map[string]string
+	// Remote is the field's original (possibly renamed) name on the
+	// remote subgraph, used when forwarding the HTTP request.
+	Remote string
+	// FieldType is the field's GraphQL type name as introspected from the
+	// remote subgraph (e.g. "String"), used by serviceSDL to render this
+	// field in the extend type block it generates for localName.
+	FieldType string
+}
+
+// remoteSchema is what loadRemoteSchema returns after introspecting one
+// @remoteGraphQL endpoint: its raw type/field listing and the forwarder
+// information resolver dispatch needs to route fields to it.
+type remoteSchema struct {
+	Endpoint string
+	Headers  map[string]string
+	Types    map[string]*introspectedType
+}
+
+type introspectedType struct {
+	Name   string
+	Kind   string
+	Fields []introspectedField
+}
+
+type introspectedField struct {
+	Name     string
+	TypeName string
+}
+
+// federationResolverMap tracks, for every (type, field) pair in the merged
+// schema, whether it should be resolved locally (using dgraphPredicate, as
+// every other field in this package already does) or forwarded to a remote
+// subgraph.
+type federationResolverMap map[string]map[string]*remoteField
+
+func newFederationResolverMap() federationResolverMap {
+	return federationResolverMap{}
+}
+
+func (m federationResolverMap) markRemote(rf remoteField) {
+	if m[rf.TypeName] == nil {
+		m[rf.TypeName] = map[string]*remoteField{}
+	}
+	m[rf.TypeName][rf.FieldName] = &rf
+}
+
+// isRemoteField reports whether field on typ should be forwarded to a
+// remote subgraph rather than resolved against Dgraph. A resolver
+// dispatcher calls this per field to decide where to send the request.
+func (m federationResolverMap) isRemoteField(typ, field string) (*remoteField, bool) {
+	fields, ok := m[typ]
+	if !ok {
+		return nil, false
+	}
+	rf, ok := fields[field]
+	return rf, ok
+}
+
+// httpPostFunc performs a single HTTP POST and returns the response body.
+// loadRemoteSchema and ExpandRemoteGraphQLDirectives take one as a parameter
+// so tests can substitute a fake transport without a real listener.
+type httpPostFunc func(url string, headers map[string]string, body []byte) ([]byte, error)
+
+// httpPostJSON is the production httpPostFunc: a plain POST with a JSON
+// body and whatever headers the directive configured.
+func httpPostJSON(url string, headers map[string]string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "while building introspection request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "while issuing introspection request")
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// introspectionResponse is the subset of a standard GraphQL introspection
+// response this package needs: the type and field names, enough to build a
+// federationResolverMap and the predicate-style field listing the rest of
+// this package already works with.
+type introspectionResponse struct {
+	Data struct {
+		Schema struct {
+			Types []struct {
+				Name   string `json:"name"`
+				Kind   string `json:"kind"`
+				Fields []struct {
+					Name string `json:"name"`
+					Type struct {
+						Name   string `json:"name"`
+						Kind   string `json:"kind"`
+						OfType *struct {
+							Name string `json:"name"`
+							Kind string `json:"kind"`
+						} `json:"ofType"`
+					} `json:"type"`
+				} `json:"fields"`
+			} `json:"types"`
+		} `json:"__schema"`
+	} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// parseIntrospectionResponse turns the raw JSON body of an introspection
+// query response into the type/field listing mergeRemoteSchema consumes.
+func parseIntrospectionResponse(body []byte) (map[string]*introspectedType, error) {
+	var r introspectionResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse introspection response")
+	}
+	if len(r.Errors) > 0 {
+		return nil, errors.Errorf("remote endpoint returned errors: %s", r.Errors[0].Message)
+	}
+
+	types := make(map[string]*introspectedType, len(r.Data.Schema.Types))
+	for _, t := range r.Data.Schema.Types {
+		it := &introspectedType{Name: t.Name, Kind: t.Kind}
+		for _, f := range t.Fields {
+			typeName := f.Type.Name
+			if typeName == "" && f.Type.OfType != nil {
+				typeName = f.Type.OfType.Name
+			}
+			it.Fields = append(it.Fields, introspectedField{Name: f.Name, TypeName: typeName})
+		}
+		types[t.Name] = it
+	}
+	return types, nil
+}
+
+// loadRemoteSchema introspects endpoint over GraphQL (via post) and returns
+// its type/field listing, ready to be merged into the local schema by
+// mergeRemoteSchema.
+func loadRemoteSchema(endpoint string, headers map[string]string, post httpPostFunc) (*remoteSchema, error) {
+	reqBody, err := json.Marshal(map[string]string{"query": introspectionQuery})
+	if err != nil {
+		return nil, errors.Wrap(err, "while building introspection request body")
+	}
+
+	respBody, err := post(endpoint, headers, reqBody)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while introspecting %s", endpoint)
+	}
+
+	types, err := parseIntrospectionResponse(respBody)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while introspecting %s", endpoint)
+	}
+
+	return &remoteSchema{Endpoint: endpoint, Headers: headers, Types: types}, nil
+}
+
+// mergeRemoteSchema merges rs's types into local (the dgraphPredicate-keyed
+// map every other field in this package already uses), applying rename to
+// pick a different local name for a remote type (e.g. because it would
+// otherwise be ambiguous with another merged subgraph), and records every
+// newly merged field as remote in resolverMap so dispatch can route to it.
+//
+// A remote type sharing a name with an existing local type is the normal
+// federation case - extending a shared entity (e.g. Author) with
+// remote-only fields - and is not an error. It's only a conflict when two
+// different remote endpoints both claim to own the same field on the same
+// type; that genuinely can't be resolved without a @rename.
+func mergeRemoteSchema(
+	local map[string]map[string]string,
+	rs *remoteSchema,
+	rename map[string]string,
+	resolverMap federationResolverMap) error {
+
+	for name, t := range rs.Types {
+		if strings.HasPrefix(name, "__") {
+			continue // introspection meta-types, not part of the real schema
+		}
+
+		localName := name
+		if renamed, ok := rename[name]; ok {
+			localName = renamed
+		}
+
+		if local[localName] == nil {
+			local[localName] = map[string]string{}
+		}
+		for _, f := range t.Fields {
+			if _, ok := local[localName][f.Name]; ok {
+				existing, isRemote := resolverMap.isRemoteField(localName, f.Name)
+				if isRemote && existing.Endpoint != rs.Endpoint {
+					return errors.Errorf(
+						"field %q on type %q is already merged in from remote endpoint %s; "+
+							"add an @rename to disambiguate", f.Name, localName, existing.Endpoint)
+				}
+				// Either a local (Dgraph-backed) field of the same name,
+				// or the same remote field merged again - nothing to do.
+				continue
+			}
+			local[localName][f.Name] = localName + "." + f.Name
+			resolverMap.markRemote(remoteField{
+				TypeName:  localName,
+				FieldName: f.Name,
+				Endpoint:  rs.Endpoint,
+				Headers:   rs.Headers,
+				Remote:    f.Name,
+				FieldType: f.TypeName,
+			})
+		}
+	}
+	return nil
+}
+
+// ExtractRemoteGraphQLEndpoints returns every endpoint URL named by a
+// `@remoteGraphQL(endpoint: "...")` directive in schemaSrc.
+func ExtractRemoteGraphQLEndpoints(schemaSrc string) []string {
+	var endpoints []string
+	for _, m := range remoteGraphQLDirectivePattern.FindAllStringSubmatch(schemaSrc, -1) {
+		endpoints = append(endpoints, m[1])
+	}
+	return endpoints
+}
+
+// ExpandRemoteGraphQLDirectives introspects every endpoint named by a
+// @remoteGraphQL directive in schemaSrc, merges the resulting types into
+// local, and returns schemaSrc with the directives stripped out (the
+// fields they pulled in are plain GraphQL fields by the time the rest of
+// the schema is parsed), the resolverMap a resolver dispatcher should
+// consult to route each merged field to its remote subgraph rather than to
+// Dgraph, and the rendered `_service { sdl }` string (see serviceSDL) a
+// federation-aware gateway would fetch from this subgraph.
+//
+// This is the entry point a schema-loading pass should run before handing
+// the result to FromString: this package does not itself own that pass, so
+// nothing calls ExpandRemoteGraphQLDirectives automatically yet.
+func ExpandRemoteGraphQLDirectives(
+	schemaSrc string,
+	local map[string]map[string]string,
+	rename map[string]string,
+	endpointHeaders map[string]map[string]string,
+	post httpPostFunc) (string, federationResolverMap, string, error) {
+
+	resolverMap := newFederationResolverMap()
+	for _, endpoint := range ExtractRemoteGraphQLEndpoints(schemaSrc) {
+		rs, err := loadRemoteSchema(endpoint, endpointHeaders[endpoint], post)
+		if err != nil {
+			return "", nil, "", err
+		}
+		if err := mergeRemoteSchema(local, rs, rename, resolverMap); err != nil {
+			return "", nil, "", err
+		}
+	}
+
+	stripped := remoteGraphQLDirectivePattern.ReplaceAllString(schemaSrc, "")
+	return stripped, resolverMap, serviceSDL(stripped, resolverMap), nil
+}
+
+// localTypeBlockPattern matches one object type definition in SDL,
+// capturing its name, its directive list (if any) and its field list, e.g.
+// `type Author @key(fields: "id") { id: ID! name: String }`. Object type
+// bodies in this package's schemas are a flat field list with no nested
+// braces, so a non-greedy match up to the first `}` is sufficient.
+var localTypeBlockPattern = regexp.MustCompile(`(?s)type\s+(\w+)((?:\s*@\w+(?:\([^)]*\))?)*)\s*\{([^}]*)\}`)
+
+// typeDirectivePattern pulls the individual `@name(...)` directives out of
+// a type's directive list (localTypeBlockPattern's second capture group).
+var typeDirectivePattern = regexp.MustCompile(`@(\w+)(?:\([^)]*\))?`)
+
+// serviceSDL renders the `_service { sdl }` field Apollo Federation expects
+// a subgraph to expose: every local object type carrying a federation
+// directive (@key, @external, @requires or @provides), echoed back from
+// schemaSrc verbatim - directives intact - plus an `extend type` block per
+// type for every field mergeRemoteSchema pulled in from a remote subgraph,
+// typed from that subgraph's own introspection.
+func serviceSDL(schemaSrc string, resolverMap federationResolverMap) string {
+	var blocks []string
+
+	for _, m := range localTypeBlockPattern.FindAllStringSubmatch(schemaSrc, -1) {
+		if !hasFederationDirective(m[2]) {
+			continue
+		}
+		blocks = append(blocks, strings.TrimSpace(m[0]))
+	}
+
+	for _, typeName := range sortedResolverMapTypes(resolverMap) {
+		blocks = append(blocks, extendTypeBlock(typeName, resolverMap[typeName]))
+	}
+
+	return strings.Join(blocks, "\n\n")
+}
+
+// hasFederationDirective reports whether directiveList (as captured by
+// localTypeBlockPattern) contains @key, @external, @requires or @provides.
+func hasFederationDirective(directiveList string) bool {
+	for _, m := range typeDirectivePattern.FindAllStringSubmatch(directiveList, -1) {
+		if isFederationDirective(m[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// extendTypeBlock renders the `extend type typeName { ... }` SDL fragment
+// for every remote field mergeRemoteSchema recorded against typeName,
+// typed from the remote subgraph's own introspection (falling back to
+// String if introspection didn't resolve a type name for the field).
+func extendTypeBlock(typeName string, fields map[string]*remoteField) string {
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		ft := fields[name].FieldType
+		if ft == "" {
+			ft = "String"
+		}
+		lines = append(lines, fmt.Sprintf("\t%s: %s", name, ft))
+	}
+	return fmt.Sprintf("extend type %s {\n%s\n}", typeName, strings.Join(lines, "\n"))
+}
+
+// sortedResolverMapTypes returns m's type names in sorted order, for
+// deterministic SDL output.
+func sortedResolverMapTypes(m federationResolverMap) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// federationDirectives are the subset of the Apollo Federation spec this
+// package passes through to the generated SDL without attempting to
+// interpret them beyond routing: @key identifies entities, and
+// @external/@requires/@provides describe field ownership across subgraphs,
+// which Dgraph itself never needs to act on beyond echoing them back in
+// _service.sdl.
+var federationDirectives = map[string]bool{
+	"key":      true,
+	"external": true,
+	"requires": true,
+	"provides": true,
+}
+
+// isFederationDirective reports whether name is one of the federation
+// directives this package passes through verbatim.
+func isFederationDirective(name string) bool {
+	return federationDirectives[name]
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeRemoteSchema_NewFieldsRoutedToRemote(t *testing.T) {
+	local := map[string]map[string]string{
+		"Author": {"name": "Author.name"},
+	}
+	rs := &remoteSchema{
+		Endpoint: "http://remote.example.com/graphql",
+		Types: map[string]*introspectedType{
+			"Author": {
+				Name:   "Author",
+				Fields: []introspectedField{{Name: "name"}, {Name: "twitterHandle"}},
+			},
+		},
+	}
+	resolverMap := newFederationResolverMap()
+
+	err := mergeRemoteSchema(local, rs, nil, resolverMap)
+	require.NoError(t, err)
+
+	require.Equal(t, "Author.name", local["Author"]["name"])
+	require.Equal(t, "Author.twitterHandle", local["Author"]["twitterHandle"])
+
+	_, isRemote := resolverMap.isRemoteField("Author", "name")
+	require.False(t, isRemote, "pre-existing local field must not be forwarded remotely")
+
+	rf, isRemote := resolverMap.isRemoteField("Author", "twitterHandle")
+	require.True(t, isRemote)
+	require.Equal(t, "http://remote.example.com/graphql", rf.Endpoint)
+}
+
+func TestMergeRemoteSchema_SameEndpointMergedTwiceIsNotAConflict(t *testing.T) {
+	local := map[string]map[string]string{}
+	resolverMap := newFederationResolverMap()
+	rs := &remoteSchema{
+		Endpoint: "http://remote.example.com/graphql",
+		Types:    map[string]*introspectedType{"Author": {Name: "Author", Fields: []introspectedField{{Name: "bio"}}}},
+	}
+
+	require.NoError(t, mergeRemoteSchema(local, rs, nil, resolverMap))
+	require.NoError(t, mergeRemoteSchema(local, rs, nil, resolverMap))
+}
+
+func TestMergeRemoteSchema_ConflictingRemoteEndpointsRequireRename(t *testing.T) {
+	local := map[string]map[string]string{}
+	resolverMap := newFederationResolverMap()
+	rsA := &remoteSchema{
+		Endpoint: "http://a.example.com/graphql",
+		Types:    map[string]*introspectedType{"Author": {Name: "Author", Fields: []introspectedField{{Name: "bio"}}}},
+	}
+	rsB := &remoteSchema{
+		Endpoint: "http://b.example.com/graphql",
+		Types:    map[string]*introspectedType{"Author": {Name: "Author", Fields: []introspectedField{{Name: "bio"}}}},
+	}
+
+	require.NoError(t, mergeRemoteSchema(local, rsA, nil, resolverMap))
+	err := mergeRemoteSchema(local, rsB, nil, resolverMap)
+	require.Error(t, err)
+}
+
+func TestMergeRemoteSchema_RenameAppliesWhenRequested(t *testing.T) {
+	local := map[string]map[string]string{}
+	rs := &remoteSchema{
+		Types: map[string]*introspectedType{"User": {Name: "User", Fields: []introspectedField{{Name: "email"}}}},
+	}
+
+	err := mergeRemoteSchema(local, rs, map[string]string{"User": "RemoteUser"}, newFederationResolverMap())
+	require.NoError(t, err)
+	require.Contains(t, local, "RemoteUser")
+	require.NotContains(t, local, "User")
+}
+
+func TestIsFederationDirective(t *testing.T) {
+	require.True(t, isFederationDirective("key"))
+	require.True(t, isFederationDirective("requires"))
+	require.False(t, isFederationDirective("search"))
+}
+
+func TestExtractRemoteGraphQLEndpoints(t *testing.T) {
+	schemaSrc := `
+	extend schema @remoteGraphQL(endpoint: "http://accounts.example.com/graphql")
+
+	type Author {
+		name: String
+	}`
+	endpoints := ExtractRemoteGraphQLEndpoints(schemaSrc)
+	require.Equal(t, []string{"http://accounts.example.com/graphql"}, endpoints)
+}
+
+func TestLoadRemoteSchema(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"data": {
+				"__schema": {
+					"types": [
+						{
+							"name": "Author",
+							"kind": "OBJECT",
+							"fields": [
+								{"name": "twitterHandle", "type": {"name": "String", "kind": "SCALAR"}}
+							]
+						}
+					]
+				}
+			}
+		}`))
+	}))
+	defer srv.Close()
+
+	rs, err := loadRemoteSchema(srv.URL, nil, httpPostJSON)
+	require.NoError(t, err)
+	require.Contains(t, rs.Types, "Author")
+	require.Equal(t, "twitterHandle", rs.Types["Author"].Fields[0].Name)
+}
+
+func TestExpandRemoteGraphQLDirectives(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"data": {
+				"__schema": {
+					"types": [
+						{
+							"name": "Author",
+							"kind": "OBJECT",
+							"fields": [
+								{"name": "twitterHandle", "type": {"name": "String", "kind": "SCALAR"}}
+							]
+						}
+					]
+				}
+			}
+		}`))
+	}))
+	defer srv.Close()
+
+	schemaSrc := `extend schema @remoteGraphQL(endpoint: "` + srv.URL + `")
+
+type Author {
+	name: String
+}`
+
+	local := map[string]map[string]string{"Author": {"name": "Author.name"}}
+	stripped, resolverMap, sdl, err := ExpandRemoteGraphQLDirectives(schemaSrc, local, nil, nil, httpPostJSON)
+	require.NoError(t, err)
+	require.NotContains(t, stripped, "@remoteGraphQL")
+
+	rf, isRemote := resolverMap.isRemoteField("Author", "twitterHandle")
+	require.True(t, isRemote)
+	require.Equal(t, srv.URL, rf.Endpoint)
+
+	require.Contains(t, sdl, "extend type Author")
+	require.Contains(t, sdl, "twitterHandle: String")
+}
+
+func TestServiceSDL_EchoesFederationTaggedLocalTypes(t *testing.T) {
+	schemaSrc := `
+type Author @key(fields: "id") {
+	id: ID!
+	name: String
+}
+
+type Post {
+	title: String
+}`
+
+	sdl := serviceSDL(schemaSrc, newFederationResolverMap())
+	require.Contains(t, sdl, `type Author @key(fields: "id")`)
+	require.NotContains(t, sdl, "type Post", "types with no federation directive are not part of _service.sdl")
+}
+
+func TestServiceSDL_RemoteMergedFieldsRenderAsExtendType(t *testing.T) {
+	resolverMap := newFederationResolverMap()
+	resolverMap.markRemote(remoteField{
+		TypeName: "Author", FieldName: "twitterHandle", FieldType: "String",
+	})
+	resolverMap.markRemote(remoteField{
+		TypeName: "Author", FieldName: "followerCount", FieldType: "Int",
+	})
+
+	sdl := serviceSDL("", resolverMap)
+	require.Contains(t, sdl, "extend type Author {")
+	require.Contains(t, sdl, "twitterHandle: String")
+	require.Contains(t, sdl, "followerCount: Int")
+}
+
+func TestServiceSDL_MissingFieldTypeFallsBackToString(t *testing.T) {
+	resolverMap := newFederationResolverMap()
+	resolverMap.markRemote(remoteField{TypeName: "Author", FieldName: "bio"})
+
+	sdl := serviceSDL("", resolverMap)
+	require.Contains(t, sdl, "bio: String")
+}
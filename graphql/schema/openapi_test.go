@@ -0,0 +1,182 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testOpenAPIDoc = `{
+	"paths": {
+		"/favMovies/{id}": {
+			"get": {
+				"operationId": "getFavMovies",
+				"parameters": [
+					{"name": "id", "in": "path", "schema": {"type": "string"}},
+					{"name": "name", "in": "query", "schema": {"type": "string"}}
+				],
+				"responses": {
+					"200": {
+						"content": {
+							"application/json": {
+								"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Movie"}}
+							}
+						}
+					}
+				}
+			}
+		}
+	},
+	"components": {
+		"schemas": {
+			"Movie": {
+				"properties": {
+					"id": {"type": "string"},
+					"name": {"type": "string"}
+				}
+			}
+		}
+	}
+}`
+
+func TestImportOpenAPI(t *testing.T) {
+	sdl, err := importOpenAPI([]byte(testOpenAPIDoc), "http://myapi.com")
+	require.NoError(t, err)
+	require.Contains(t, sdl, "type Movie {")
+	require.Contains(t, sdl, "id: String")
+	require.Contains(t, sdl, "name: String")
+	require.Contains(t, sdl, "type Query {")
+	require.Contains(t, sdl, `url: "http://myapi.com/favMovies/$id?name=$name"`)
+	require.Contains(t, sdl, `method: "GET"`)
+}
+
+func TestImportOpenAPI_InvalidDoc(t *testing.T) {
+	_, err := importOpenAPI([]byte("not a valid spec {{{"), "http://myapi.com")
+	require.Error(t, err)
+}
+
+func TestRefName(t *testing.T) {
+	require.Equal(t, "Movie", refName("#/components/schemas/Movie"))
+}
+
+const testOpenAPIDocWithRequestBody = `{
+	"paths": {
+		"/favMovies": {
+			"post": {
+				"operationId": "addFavMovie",
+				"requestBody": {
+					"content": {
+						"application/json": {
+							"schema": {"$ref": "#/components/schemas/NewMovie"}
+						}
+					}
+				},
+				"responses": {
+					"200": {
+						"content": {
+							"application/json": {
+								"schema": {"$ref": "#/components/schemas/Movie"}
+							}
+						}
+					}
+				}
+			}
+		}
+	},
+	"components": {
+		"schemas": {
+			"NewMovie": {
+				"properties": {
+					"name": {"type": "string"},
+					"year": {"type": "integer"}
+				}
+			},
+			"Movie": {
+				"properties": {
+					"id": {"type": "string"}
+				}
+			}
+		}
+	}
+}`
+
+func TestImportOpenAPI_BuildsBodyTemplateFromRequestBody(t *testing.T) {
+	sdl, err := importOpenAPI([]byte(testOpenAPIDocWithRequestBody), "http://myapi.com")
+	require.NoError(t, err)
+	require.Contains(t, sdl, `body: "{ name: $name, year: $year }"`)
+	require.Contains(t, sdl, "name: String")
+	require.Contains(t, sdl, "year: Int")
+	require.Contains(t, sdl, `method: "POST"`)
+}
+
+func TestBodyTemplateFromSchema_ProducesAParseBodyTemplateCompatibleTemplate(t *testing.T) {
+	template, args, err := bodyTemplateFromSchema(map[string]interface{}{
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{"type": "string"},
+			"year": map[string]interface{}{"type": "integer"},
+		},
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"name: String", "year: Int"}, args)
+
+	parsed, required, err := parseBodyTemplate(template)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"name": true, "year": true}, required)
+	require.Equal(t, map[string]interface{}{"name": "$name", "year": "$year"}, parsed)
+}
+
+func TestExtractOpenAPIEndpoints(t *testing.T) {
+	schemaSrc := `
+	extend schema @remote(openapi: "https://api.example.com/openapi.json")
+
+	type Author {
+		name: String
+	}`
+	require.Equal(t, []string{"https://api.example.com/openapi.json"}, ExtractOpenAPIEndpoints(schemaSrc))
+}
+
+func TestExpandOpenAPIDirectives(t *testing.T) {
+	fetch := func(url string) ([]byte, error) {
+		require.Equal(t, "https://api.example.com/openapi.json", url)
+		return []byte(testOpenAPIDoc), nil
+	}
+
+	schemaSrc := `extend schema @remote(openapi: "https://api.example.com/openapi.json")
+
+type Author {
+	name: String
+}`
+
+	expanded, err := ExpandOpenAPIDirectives(schemaSrc, fetch)
+	require.NoError(t, err)
+	require.NotContains(t, expanded, "@remote(openapi:")
+	require.Contains(t, expanded, "type Author {")
+	require.Contains(t, expanded, "type Movie {")
+	require.Contains(t, expanded, `url: "https://api.example.com/favMovies/$id?name=$name"`)
+}
+
+func TestExpandOpenAPIDirectives_NoDirectiveIsANoop(t *testing.T) {
+	schemaSrc := "type Author {\n\tname: String\n}"
+	expanded, err := ExpandOpenAPIDirectives(schemaSrc, func(string) ([]byte, error) {
+		t.Fatal("fetch should not be called when there's no @remote directive")
+		return nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, schemaSrc, expanded)
+}
@@ -0,0 +1,578 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The template AST below is a richer alternative to parseBodyTemplate and
+// substituteVarsInBody (see wrappers.go) for @custom fields that need
+// `@include`/`@skip` guards, `??` defaults or `for` loops: parseTemplateAST
+// and evalTemplate parse and substitute in one pass, against a single vars
+// map, rather than parsing once and substituting separately per request.
+// Templates that don't need any of that still go through the plain
+// parseBodyTemplate/substituteVarsInBody pair.
+
+// templateNode is the AST for a body/URL template. Each node is one of:
+// a literal JSON value, a variable reference (possibly with a default or
+// field path), a conditional object entry, or a loop that expands a list
+// variable into a JSON array.
+type templateNode interface {
+	// eval resolves the node against vars, recording any variable it
+	// reads into required (unless the read is guarded by @include/@skip or
+	// backed by a default).
+	eval(vars map[string]interface{}, required map[string]bool) (interface{}, bool, error)
+}
+
+// literalNode is a JSON value with no `$` references left inside it.
+type literalNode struct {
+	val interface{}
+}
+
+func (n *literalNode) eval(map[string]interface{}, map[string]bool) (interface{}, bool, error) {
+	return n.val, true, nil
+}
+
+// varNode is a `$name`, optionally with a `.field.path` and/or a `?? default`.
+type varNode struct {
+	name     string
+	path     []string
+	hasDef   bool
+	def      interface{}
+	optional bool // true when guarded by @skip/@include such that a missing value is not required
+}
+
+func (n *varNode) eval(vars map[string]interface{}, required map[string]bool) (interface{}, bool, error) {
+	val, ok := vars[n.name]
+	if !ok {
+		if n.hasDef {
+			return n.def, true, nil
+		}
+		if !n.optional {
+			required[n.name] = true
+		}
+		if n.optional {
+			return nil, false, nil
+		}
+		return nil, false, errors.Errorf("couldn't find variable: $%s in variables map", n.name)
+	}
+	if !n.hasDef && !n.optional {
+		required[n.name] = true
+	}
+
+	for _, field := range n.path {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, false, errors.Errorf("can't access field %s on non-object value of $%s", field, n.name)
+		}
+		val, ok = m[field]
+		if !ok {
+			if n.hasDef {
+				return n.def, true, nil
+			}
+			return nil, false, errors.Errorf("couldn't find field %s on $%s", field, n.name)
+		}
+	}
+	return val, true, nil
+}
+
+// objectNode is a JSON object template; each entry may be guarded by an
+// @include/@skip condition referencing a boolean variable.
+type objectNode struct {
+	keys   []string
+	vals   []templateNode
+	guards []guard // parallel to keys/vals; zero value means "always included"
+}
+
+type guard struct {
+	variable string
+	want     bool // true for @include, false for @skip
+	has      bool
+}
+
+func (n *objectNode) eval(vars map[string]interface{}, required map[string]bool) (interface{}, bool, error) {
+	out := make(map[string]interface{}, len(n.keys))
+	for i, k := range n.keys {
+		if g := n.guards[i]; g.has {
+			gv, ok := vars[g.variable]
+			if !ok {
+				return nil, false, errors.Errorf("couldn't find variable: $%s in variables map", g.variable)
+			}
+			b, ok := gv.(bool)
+			if !ok {
+				return nil, false, errors.Errorf("variable $%s used in @include/@skip must be a boolean", g.variable)
+			}
+			if b != g.want {
+				continue
+			}
+		}
+		v, ok, err := n.vals[i].eval(vars, required)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			continue
+		}
+		out[k] = v
+	}
+	return out, true, nil
+}
+
+// loopNode expands `[for $item in $list: { ... }]` into a JSON array, one
+// entry per element of the list variable, with `item` bound to each element
+// inside the body template.
+type loopNode struct {
+	iterVar string
+	listVar string
+	body    templateNode
+}
+
+func (n *loopNode) eval(vars map[string]interface{}, required map[string]bool) (interface{}, bool, error) {
+	list, ok := vars[n.listVar]
+	if !ok {
+		return nil, false, errors.Errorf("couldn't find variable: $%s in variables map", n.listVar)
+	}
+	required[n.listVar] = true
+
+	items, ok := list.([]interface{})
+	if !ok {
+		return nil, false, errors.Errorf("variable $%s used in a for-loop must be a list", n.listVar)
+	}
+
+	out := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		scoped := make(map[string]interface{}, len(vars)+1)
+		for k, v := range vars {
+			scoped[k] = v
+		}
+		scoped[n.iterVar] = item
+		v, ok, err := n.body.eval(scoped, required)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			out = append(out, v)
+		}
+	}
+	return out, true, nil
+}
+
+// templateParser turns template text (a superset of the `{ ... }` syntax
+// parseBodyTemplate accepts, extended with defaults/guards/loops) into a
+// templateNode tree, and collects the set of variables that must be
+// supplied for the template to evaluate without hitting a required-but-
+// missing variable.
+type templateParser struct {
+	s   string
+	pos int
+}
+
+// parseTemplateAST parses template text into a templateNode and the set of
+// variables that are referenced outside of a @skip/@include guard or `??`
+// default. The variable named in a guard's `if:` is not part of that set,
+// but evaluation fails if it is missing, so the caller must supply it too.
+func parseTemplateAST(template string) (templateNode, map[string]bool, error) {
+	p := &templateParser{s: template}
+	p.skipSpace()
+	node, err := p.parseValue()
+	if err != nil {
+		return nil, nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.s) {
+		return nil, nil, errors.New("found unmatched curly braces while parsing body template")
+	}
+
+	required := map[string]bool{}
+	collectRequiredVars(node, required)
+	return node, required, nil
+}
+
+// collectRequiredVars statically walks the AST to report which variables a
+// template references unconditionally - used only to answer "what must the
+// caller supply", not to evaluate anything.
+func collectRequiredVars(n templateNode, required map[string]bool) {
+	switch n := n.(type) {
+	case *varNode:
+		if !n.hasDef && !n.optional {
+			required[n.name] = true
+		}
+	case *objectNode:
+		for i, v := range n.vals {
+			if n.guards[i].has {
+				continue
+			}
+			collectRequiredVars(v, required)
+		}
+	case *arrayNode:
+		for _, item := range n.items {
+			collectRequiredVars(item, required)
+		}
+	case *loopNode:
+		required[n.listVar] = true
+		body := map[string]bool{}
+		collectRequiredVars(n.body, body)
+		delete(body, n.iterVar)
+		for name := range body {
+			required[name] = true
+		}
+	}
+}
+
+func (p *templateParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t' || p.s[p.pos] == '\n' || p.s[p.pos] == '\r') {
+		p.pos++
+	}
+}
+
+func (p *templateParser) peek() byte {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *templateParser) parseValue() (templateNode, error) {
+	p.skipSpace()
+	switch c := p.peek(); {
+	case c == '{':
+		return p.parseObject()
+	case c == '[':
+		return p.parseArrayOrLoop()
+	case c == '$':
+		return p.parseVar()
+	case c == '"':
+		s, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		return &literalNode{val: s}, nil
+	case c >= '0' && c <= '9', c == '-':
+		return p.parseNumber()
+	case strings.HasPrefix(p.s[p.pos:], "true"):
+		p.pos += 4
+		return &literalNode{val: true}, nil
+	case strings.HasPrefix(p.s[p.pos:], "false"):
+		p.pos += 5
+		return &literalNode{val: false}, nil
+	case strings.HasPrefix(p.s[p.pos:], "null"):
+		p.pos += 4
+		return &literalNode{val: nil}, nil
+	default:
+		return nil, errors.Errorf("invalid character: %c while parsing body template", c)
+	}
+}
+
+func (p *templateParser) parseObject() (templateNode, error) {
+	p.pos++ // consume '{'
+	obj := &objectNode{}
+	p.skipSpace()
+	if p.peek() == '}' {
+		p.pos++
+		return obj, nil
+	}
+	for {
+		p.skipSpace()
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.peek() != ':' {
+			return nil, errors.New("couldn't unmarshal HTTP body: expected ':' while parsing body template")
+		}
+		p.pos++
+
+		g, err := p.maybeParseGuard()
+		if err != nil {
+			return nil, err
+		}
+
+		val, err := p.parseValueWithDefault()
+		if err != nil {
+			return nil, err
+		}
+		if vn, ok := val.(*varNode); ok && g.has {
+			vn.optional = true
+		}
+
+		obj.keys = append(obj.keys, key)
+		obj.vals = append(obj.vals, val)
+		obj.guards = append(obj.guards, g)
+
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+			continue
+		case '}':
+			p.pos++
+			return obj, nil
+		default:
+			return nil, errors.New("found unmatched curly braces while parsing body template")
+		}
+	}
+}
+
+// maybeParseGuard consumes a leading `@include(if: $x)` or `@skip(if: $x)`
+// before a value, if present.
+func (p *templateParser) maybeParseGuard() (guard, error) {
+	p.skipSpace()
+	var want bool
+	switch {
+	case strings.HasPrefix(p.s[p.pos:], "@include"):
+		want = true
+		p.pos += len("@include")
+	case strings.HasPrefix(p.s[p.pos:], "@skip"):
+		want = false
+		p.pos += len("@skip")
+	default:
+		return guard{}, nil
+	}
+
+	p.skipSpace()
+	if p.peek() != '(' {
+		return guard{}, errors.New("expected '(' after @include/@skip in body template")
+	}
+	p.pos++
+	p.skipSpace()
+	if !strings.HasPrefix(p.s[p.pos:], "if:") {
+		return guard{}, errors.New("expected 'if:' inside @include/@skip in body template")
+	}
+	p.pos += len("if:")
+	p.skipSpace()
+	if p.peek() != '$' {
+		return guard{}, errors.New("expected variable after 'if:' in body template")
+	}
+	p.pos++
+	name := p.parseIdent()
+	p.skipSpace()
+	if p.peek() != ')' {
+		return guard{}, errors.New("expected ')' to close @include/@skip in body template")
+	}
+	p.pos++
+	return guard{variable: name, want: want, has: true}, nil
+}
+
+// parseValueWithDefault parses a value, then an optional `?? default`.
+func (p *templateParser) parseValueWithDefault() (templateNode, error) {
+	val, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if strings.HasPrefix(p.s[p.pos:], "??") {
+		p.pos += 2
+		p.skipSpace()
+		def, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if vn, ok := val.(*varNode); ok {
+			defLit, ok := def.(*literalNode)
+			if !ok {
+				return nil, errors.New("default value after ?? must be a literal")
+			}
+			vn.hasDef = true
+			vn.def = defLit.val
+			return vn, nil
+		}
+		return nil, errors.New("?? default is only supported after a $variable")
+	}
+	return val, nil
+}
+
+func (p *templateParser) parseKey() (string, error) {
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != ':' && p.s[p.pos] != ' ' {
+		p.pos++
+	}
+	if start == p.pos {
+		return "", errors.New("couldn't unmarshal HTTP body: expected a key while parsing body template")
+	}
+	return strings.Trim(p.s[start:p.pos], `"`), nil
+}
+
+func (p *templateParser) parseIdent() string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.s[start:p.pos]
+}
+
+// parseVar parses `$name`, optionally followed by `.field.path`.
+func (p *templateParser) parseVar() (templateNode, error) {
+	p.pos++ // consume '$'
+	name := p.parseIdent()
+	if name == "" {
+		return nil, errors.New("expected variable name after '$' while parsing body template")
+	}
+	v := &varNode{name: name}
+	for p.peek() == '.' {
+		p.pos++
+		field := p.parseIdent()
+		if field == "" {
+			return nil, errors.Errorf("expected field name after '.' in $%s", name)
+		}
+		v.path = append(v.path, field)
+	}
+	return v, nil
+}
+
+func (p *templateParser) parseArrayOrLoop() (templateNode, error) {
+	p.pos++ // consume '['
+	p.skipSpace()
+	if strings.HasPrefix(p.s[p.pos:], "for ") || strings.HasPrefix(p.s[p.pos:], "for\t") {
+		return p.parseLoop()
+	}
+
+	arr := &arrayNode{}
+	p.skipSpace()
+	if p.peek() == ']' {
+		p.pos++
+		return arr, nil
+	}
+	for {
+		v, err := p.parseValueWithDefault()
+		if err != nil {
+			return nil, err
+		}
+		arr.items = append(arr.items, v)
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+			continue
+		case ']':
+			p.pos++
+			return arr, nil
+		default:
+			return nil, errors.New("found unmatched curly braces while parsing body template")
+		}
+	}
+}
+
+// parseLoop parses `for $item in $list: <body>]`.
+func (p *templateParser) parseLoop() (templateNode, error) {
+	p.pos += len("for")
+	p.skipSpace()
+	if p.peek() != '$' {
+		return nil, errors.New("expected iteration variable after 'for' in body template")
+	}
+	p.pos++
+	iterVar := p.parseIdent()
+
+	p.skipSpace()
+	if !strings.HasPrefix(p.s[p.pos:], "in") {
+		return nil, errors.New("expected 'in' in for-loop while parsing body template")
+	}
+	p.pos += len("in")
+
+	p.skipSpace()
+	if p.peek() != '$' {
+		return nil, errors.New("expected list variable after 'in' in body template")
+	}
+	p.pos++
+	listVar := p.parseIdent()
+
+	p.skipSpace()
+	if p.peek() != ':' {
+		return nil, errors.New("expected ':' in for-loop while parsing body template")
+	}
+	p.pos++
+
+	body, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if p.peek() != ']' {
+		return nil, errors.New("found unmatched curly braces while parsing body template")
+	}
+	p.pos++
+
+	return &loopNode{iterVar: iterVar, listVar: listVar, body: body}, nil
+}
+
+// arrayNode is a JSON array template whose elements may themselves contain
+// variable references - but, unlike loopNode, has a fixed length known at
+// parse time.
+type arrayNode struct {
+	items []templateNode
+}
+
+func (n *arrayNode) eval(vars map[string]interface{}, required map[string]bool) (interface{}, bool, error) {
+	out := make([]interface{}, 0, len(n.items))
+	for _, item := range n.items {
+		v, ok, err := item.eval(vars, required)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			out = append(out, v)
+		}
+	}
+	return out, true, nil
+}
+
+func (p *templateParser) parseString() (string, error) {
+	p.pos++ // consume opening quote
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != '"' {
+		p.pos++
+	}
+	if p.pos >= len(p.s) {
+		return "", errors.New("couldn't unmarshal HTTP body: unterminated string while parsing body template")
+	}
+	s := p.s[start:p.pos]
+	p.pos++ // consume closing quote
+	return s, nil
+}
+
+func (p *templateParser) parseNumber() (templateNode, error) {
+	start := p.pos
+	if p.peek() == '-' {
+		p.pos++
+	}
+	for p.pos < len(p.s) && (p.s[p.pos] >= '0' && p.s[p.pos] <= '9' || p.s[p.pos] == '.') {
+		p.pos++
+	}
+	n, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+	if err != nil {
+		return nil, errors.Errorf("couldn't parse number while parsing body template: %s", p.s[start:p.pos])
+	}
+	return &literalNode{val: n}, nil
+}
+
+// evalTemplate evaluates a previously parsed template AST against vars,
+// returning a JSON-serialisable value with every variable substituted and
+// every default, conditional and loop resolved.
+func evalTemplate(node templateNode, vars map[string]interface{}) (interface{}, error) {
+	v, _, err := node.eval(vars, map[string]bool{})
+	return v, err
+}
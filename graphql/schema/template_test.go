@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTemplateAST_Default(t *testing.T) {
+	node, required, err := parseTemplateAST(`{ name: $name ?? "anonymous" }`)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{}, required)
+
+	v, err := evalTemplate(node, map[string]interface{}{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"name": "anonymous"}, v)
+
+	v, err = evalTemplate(node, map[string]interface{}{"name": "Michael"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"name": "Michael"}, v)
+}
+
+func TestParseTemplateAST_IncludeSkip(t *testing.T) {
+	node, required, err := parseTemplateAST(
+		`{ author: $id, secret: @include(if: $admin) $token }`)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"id": true}, required)
+
+	v, err := evalTemplate(node, map[string]interface{}{"id": "0x3", "admin": false})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"author": "0x3"}, v)
+
+	v, err = evalTemplate(node, map[string]interface{}{"id": "0x3", "admin": true, "token": "tok"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"author": "0x3", "secret": "tok"}, v)
+}
+
+func TestParseTemplateAST_NestedFieldAccess(t *testing.T) {
+	node, required, err := parseTemplateAST(`{ email: $user.profile.email }`)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"user": true}, required)
+
+	vars := map[string]interface{}{
+		"user": map[string]interface{}{
+			"profile": map[string]interface{}{"email": "a@example.com"},
+		},
+	}
+	v, err := evalTemplate(node, vars)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"email": "a@example.com"}, v)
+}
+
+func TestParseTemplateAST_Loop(t *testing.T) {
+	node, required, err := parseTemplateAST(
+		`{ comments: [for $c in $comments: { text: $c.text }] }`)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"comments": true}, required)
+
+	vars := map[string]interface{}{
+		"comments": []interface{}{
+			map[string]interface{}{"text": "first"},
+			map[string]interface{}{"text": "second"},
+		},
+	}
+	v, err := evalTemplate(node, vars)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"comments": []interface{}{
+			map[string]interface{}{"text": "first"},
+			map[string]interface{}{"text": "second"},
+		},
+	}, v)
+}
+
+func TestParseTemplateAST_MissingRequiredVar(t *testing.T) {
+	node, _, err := parseTemplateAST(`{ author: $id }`)
+	require.NoError(t, err)
+
+	_, err = evalTemplate(node, map[string]interface{}{})
+	require.EqualError(t, err, "couldn't find variable: $id in variables map")
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// parseBodyTemplate turns a @custom(http: {body: "..."}) template into a
+// map that mirrors its JSON structure, with every bare identifier quoted as
+// a string and every $var placeholder left in place (still prefixed with
+// $) so substituteVarsInBody can fill it in per request. It also returns
+// the set of variable names the template references, so callers can check
+// they're all available before issuing the call.
+//
+// template isn't valid JSON on its own - object keys and $var values are
+// unquoted - so it's parsed by hand: walk it once, quoting identifiers and
+// rejecting characters that can't appear in one, then hand the result to
+// encoding/json.
+func parseBodyTemplate(template string) (map[string]interface{}, map[string]bool, error) {
+	quoted, required, err := quoteBodyTemplateIdents(template)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var b map[string]interface{}
+	if err := json.Unmarshal([]byte(quoted), &b); err != nil {
+		return nil, nil, errors.Errorf("couldn't unmarshal HTTP body: %s as JSON", quoted)
+	}
+	return b, required, nil
+}
+
+// quoteBodyTemplateIdents rewrites template's bare object keys and $var
+// placeholders as JSON strings, leaving every other character (braces,
+// brackets, colons, commas, whitespace) untouched, and collects every $var
+// name it encounters along the way.
+func quoteBodyTemplateIdents(template string) (string, map[string]bool, error) {
+	var out strings.Builder
+	required := map[string]bool{}
+	var depth []byte
+
+	for i := 0; i < len(template); {
+		c := template[i]
+		switch {
+		case c == '{' || c == '[':
+			depth = append(depth, c)
+			out.WriteByte(c)
+			i++
+		case c == '}' || c == ']':
+			if len(depth) == 0 {
+				return "", nil, errors.New("found unmatched curly braces while parsing body template")
+			}
+			depth = depth[:len(depth)-1]
+			out.WriteByte(c)
+			i++
+		case c == ':' || c == ',':
+			out.WriteByte(c)
+			i++
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '$' || isIdentStart(c):
+			start := i
+			isVar := c == '$'
+			if isVar {
+				i++
+			}
+			for i < len(template) && isIdentByte(template[i]) {
+				i++
+			}
+			if isVar && i == start+1 {
+				return "", nil, errors.Errorf("invalid character: %c while parsing body template", c)
+			}
+			ident := template[start:i]
+			if isVar {
+				required[ident[1:]] = true
+			}
+			out.WriteByte('"')
+			out.WriteString(ident)
+			out.WriteByte('"')
+		default:
+			return "", nil, errors.Errorf("invalid character: %c while parsing body template", c)
+		}
+	}
+
+	if len(depth) != 0 {
+		return "", nil, errors.New("found unmatched curly braces while parsing body template")
+	}
+	return out.String(), required, nil
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isIdentByte(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+// substituteVarsInBody walks body (as produced by parseBodyTemplate) in
+// place, replacing every "$var" placeholder with the corresponding value
+// from variables.
+func substituteVarsInBody(body map[string]interface{}, variables map[string]interface{}) error {
+	for k, v := range body {
+		nv, err := substituteVarsInValue(v, variables)
+		if err != nil {
+			return err
+		}
+		body[k] = nv
+	}
+	return nil
+}
+
+func substituteVarsInValue(v interface{}, variables map[string]interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		if !strings.HasPrefix(val, "$") {
+			return val, nil
+		}
+		sub, ok := variables[val[1:]]
+		if !ok {
+			return nil, errors.Errorf("couldn't find variable: %s in variables map", val)
+		}
+		return sub, nil
+	case map[string]interface{}:
+		if err := substituteVarsInBody(val, variables); err != nil {
+			return nil, err
+		}
+		return val, nil
+	case []interface{}:
+		for i, item := range val {
+			nv, err := substituteVarsInValue(item, variables)
+			if err != nil {
+				return nil, err
+			}
+			val[i] = nv
+		}
+		return val, nil
+	default:
+		return val, nil
+	}
+}
+
+// substituteVarsInURL fills $var placeholders into a @custom(http: {url:
+// "..."}) template: path segments are replaced with the variable's value
+// verbatim, and query parameters are dropped entirely if their variable
+// wasn't supplied, rendered empty if it was supplied as nil, and otherwise
+// query-escaped (so e.g. a space becomes "+", matching net/url's
+// convention for query values).
+func substituteVarsInURL(urlTemplate string, variables map[string]interface{}) (string, error) {
+	parts := strings.SplitN(urlTemplate, "?", 2)
+	path := substituteVarsInPath(parts[0], variables)
+	if len(parts) == 1 {
+		return path, nil
+	}
+
+	var kept []string
+	for _, pair := range strings.Split(parts[1], "&") {
+		kv := strings.SplitN(pair, "=", 2)
+		key, val := kv[0], ""
+		if len(kv) == 2 {
+			val = kv[1]
+		}
+
+		if strings.HasPrefix(val, "$") {
+			v, ok := variables[val[1:]]
+			if !ok {
+				continue
+			}
+			if v == nil {
+				val = ""
+			} else {
+				val = url.QueryEscape(toURLString(v))
+			}
+		}
+		kept = append(kept, key+"="+val)
+	}
+	if len(kept) == 0 {
+		return path, nil
+	}
+	return path + "?" + strings.Join(kept, "&"), nil
+}
+
+func substituteVarsInPath(path string, variables map[string]interface{}) string {
+	var b strings.Builder
+	for i := 0; i < len(path); {
+		if path[i] != '$' {
+			b.WriteByte(path[i])
+			i++
+			continue
+		}
+		start := i
+		i++
+		for i < len(path) && isIdentByte(path[i]) {
+			i++
+		}
+		name := path[start+1 : i]
+		if v, ok := variables[name]; ok && v != nil {
+			b.WriteString(toURLString(v))
+		}
+	}
+	return b.String()
+}
+
+func toURLString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	s := string(b)
+	return strings.Trim(s, `"`)
+}